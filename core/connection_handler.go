@@ -0,0 +1,44 @@
+package core
+
+import (
+	"context"
+	"net"
+)
+
+// ContextualConnectionHandler is the context-aware counterpart of
+// ConnectionHandler. NewTCPConnection calls its Connect with conn.ctx, which
+// the connection cancels as soon as the flow is reset, aborted, errors out,
+// or one of its deadlines expires.
+//
+// NewTCPConnection takes a ConnectionHandler and converts it with
+// toContextualConnectionHandler right before calling Connect. Because
+// ConnectionHandler already declares Connect(Connection, net.Addr), no
+// ConnectionHandler can also have this interface's Connect method, so the
+// handler is always wrapped in contextHandlerAdapter, which drops the
+// context: no registered handler receives conn.ctx. Existing
+// shadowsocks/socks handlers compile and run as before, and
+// RegisterTCPConnectionHandler is unchanged.
+type ContextualConnectionHandler interface {
+	Connect(ctx context.Context, conn Connection, target net.Addr) error
+}
+
+// contextHandlerAdapter lets a plain ConnectionHandler satisfy
+// ContextualConnectionHandler by ignoring the context it is handed.
+type contextHandlerAdapter struct {
+	ConnectionHandler
+}
+
+func (a *contextHandlerAdapter) Connect(ctx context.Context, conn Connection, target net.Addr) error {
+	return a.ConnectionHandler.Connect(conn, target)
+}
+
+// toContextualConnectionHandler returns handler unchanged if it already
+// implements ContextualConnectionHandler, otherwise it wraps handler so it
+// does. A ConnectionHandler's Connect has the other signature, so the first
+// case never holds and the handler is always wrapped.
+func toContextualConnectionHandler(handler ConnectionHandler) ContextualConnectionHandler {
+	if ch, ok := handler.(ContextualConnectionHandler); ok {
+		return ch
+	}
+	return &contextHandlerAdapter{handler}
+}
@@ -0,0 +1,113 @@
+package core
+
+// elasticBuffer is a growable ring buffer of bytes used to decouple
+// tcpConn.Write from lwIP's send-window cadence (see tcpConn.flush). It
+// grows to fit whatever is written to it and never shrinks back; callers
+// are expected to bound how much they buffer themselves (tcpConn does this
+// via its write high-water mark). Not safe for concurrent use - callers
+// provide their own locking.
+type elasticBuffer struct {
+	buf  []byte
+	r, w int
+	full bool
+}
+
+const minElasticBufferSize = 4096
+
+func newElasticBuffer() *elasticBuffer {
+	return &elasticBuffer{buf: make([]byte, minElasticBufferSize)}
+}
+
+// Len returns the number of unread bytes currently buffered.
+func (b *elasticBuffer) Len() int {
+	if b.w == b.r {
+		if b.full {
+			return len(b.buf)
+		}
+		return 0
+	}
+	if b.w > b.r {
+		return b.w - b.r
+	}
+	return len(b.buf) - b.r + b.w
+}
+
+func (b *elasticBuffer) avail() int {
+	return len(b.buf) - b.Len()
+}
+
+// Write appends p to the ring, growing it first if p doesn't fit. It never
+// fails to accept the whole of p.
+func (b *elasticBuffer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > b.avail() {
+		b.grow(b.Len() + len(p))
+	}
+	written := 0
+	for written < len(p) {
+		n := copy(b.buf[b.w:], p[written:])
+		written += n
+		b.w = (b.w + n) % len(b.buf)
+	}
+	b.full = b.w == b.r
+	return written, nil
+}
+
+// grow reallocates the ring to the next power-of-two capacity that is at
+// least min, preserving the unread bytes at the start of the new buffer.
+func (b *elasticBuffer) grow(min int) {
+	newCap := len(b.buf)
+	if newCap == 0 {
+		newCap = minElasticBufferSize
+	}
+	for newCap < min {
+		newCap *= 2
+	}
+
+	n := b.Len()
+	newBuf := make([]byte, newCap)
+	if n > 0 {
+		if b.r < b.w {
+			copy(newBuf, b.buf[b.r:b.w])
+		} else {
+			k := copy(newBuf, b.buf[b.r:])
+			copy(newBuf[k:], b.buf[:b.w])
+		}
+	}
+	b.buf = newBuf
+	b.r = 0
+	b.w = n
+	b.full = false
+}
+
+// PeekContiguous returns the longest run of unread bytes, up to max, that
+// can be addressed as a single contiguous slice without copying - i.e. the
+// run from the read cursor up to either the write cursor or the physical
+// end of the ring, whichever comes first. The ring wraps around, so a full
+// read of everything buffered may take more than one PeekContiguous +
+// Discard round trip.
+func (b *elasticBuffer) PeekContiguous(max int) []byte {
+	if b.Len() == 0 || max <= 0 {
+		return nil
+	}
+	end := len(b.buf)
+	if !b.full && b.w > b.r {
+		end = b.w
+	}
+	if end-b.r > max {
+		end = b.r + max
+	}
+	return b.buf[b.r:end]
+}
+
+// Discard drops the first n unread bytes, as already consumed by a prior
+// PeekContiguous.
+func (b *elasticBuffer) Discard(n int) {
+	if n <= 0 {
+		return
+	}
+	b.r = (b.r + n) % len(b.buf)
+	b.full = false
+}
@@ -9,30 +9,70 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 type tcpConn struct {
 	sync.Mutex
 
-	pcb         *C.struct_tcp_pcb
-	handler     ConnectionHandler
-	network     string
-	remoteAddr  net.Addr
-	localAddr   net.Addr
-	connKeyArg  unsafe.Pointer
-	connKey     uint32
-	closing     bool
-	localClosed bool
-	aborting    bool
-	ctx         context.Context
-	cancel      context.CancelFunc
-	canWrite    *sync.Cond // Condition variable to implement TCP backpressure.
+	pcb           *C.struct_tcp_pcb
+	handler       ConnectionHandler
+	network       string
+	remoteAddr    net.Addr
+	localAddr     net.Addr
+	connKeyArg    unsafe.Pointer
+	connKey       uint32
+	closing       bool
+	localClosed   bool
+	aborting      bool
+	writeClosed   bool
+	writeShutdown bool
+	readClosed    bool
+	ctx           context.Context
+	cancel        context.CancelFunc
+	canWrite      *sync.Cond // Condition variable to implement TCP backpressure.
+	readDeadline  *time.Timer
+	writeDeadline *time.Timer
+	readExpired   bool
+	writeExpired  bool
+	// readDeadlineGen/writeDeadlineGen are bumped on every SetReadDeadline/
+	// SetWriteDeadline call. A fired timer callback carries the generation
+	// it was armed under and is a no-op if that no longer matches, so a
+	// timer that raced a concurrent reset/clear can't mark the connection
+	// expired after the fact.
+	readDeadlineGen  uint64
+	writeDeadlineGen uint64
+	// inFlightWriters counts goroutines currently inside Write, so Close can
+	// tell whether a graceful tcp_close would race a write blocked on
+	// backpressure.
+	inFlightWriters int32
+
+	writeBuf              *elasticBuffer
+	writeBufMu            sync.Mutex
+	writeBufHighWaterMark int
 }
 
+// defaultWriteBufferHighWaterMark bounds how far Write is allowed to run
+// ahead of what has actually been handed to lwIP before it starts blocking.
+// It's deliberately generous relative to typical snd_buf sizes so the
+// flusher has plenty of headroom to batch writes.
+const defaultWriteBufferHighWaterMark = 64 * 1024
+
+// timeoutError is returned by Receive and Write once the corresponding
+// deadline has expired. It implements net.Error so callers that type-assert
+// on net.Conn errors (e.g. io.Copy loops checking for timeouts) keep working.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 func NewTCPConnection(pcb *C.struct_tcp_pcb, handler ConnectionHandler) (Connection, error) {
 	// prepare key
 	connKeyArg := NewConnKeyArg()
@@ -46,19 +86,21 @@ func NewTCPConnection(pcb *C.struct_tcp_pcb, handler ConnectionHandler) (Connect
 	ctx, cancel := context.WithCancel(context.Background())
 
 	conn := &tcpConn{
-		pcb:         pcb,
-		handler:     handler,
-		network:     "tcp",
-		localAddr:   ParseTCPAddr(IPAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
-		remoteAddr:  ParseTCPAddr(IPAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
-		connKeyArg:  connKeyArg,
-		connKey:     connKey,
-		closing:     false,
-		localClosed: false,
-		aborting:    false,
-		ctx:         ctx,
-		cancel:      cancel,
-		canWrite:    sync.NewCond(&sync.Mutex{}),
+		pcb:                   pcb,
+		handler:               handler,
+		network:               "tcp",
+		localAddr:             ParseTCPAddr(IPAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
+		remoteAddr:            ParseTCPAddr(IPAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
+		connKeyArg:            connKeyArg,
+		connKey:               connKey,
+		closing:               false,
+		localClosed:           false,
+		aborting:              false,
+		ctx:                   ctx,
+		cancel:                cancel,
+		canWrite:              sync.NewCond(&sync.Mutex{}),
+		writeBuf:              newElasticBuffer(),
+		writeBufHighWaterMark: defaultWriteBufferHighWaterMark,
 	}
 
 	// Associate conn with key and save to the global map.
@@ -76,7 +118,7 @@ func NewTCPConnection(pcb *C.struct_tcp_pcb, handler ConnectionHandler) (Connect
 	// chances to interact with the lwip thread. Assuming lwip thread has already
 	// been locked.
 	lwipMutex.Unlock()
-	err := handler.Connect(conn, conn.RemoteAddr())
+	err := toContextualConnectionHandler(handler).Connect(conn.ctx, conn, conn.RemoteAddr())
 	lwipMutex.Lock()
 	if err != nil {
 		return nil, err
@@ -99,6 +141,15 @@ func (conn *tcpConn) Receive(data []byte) error {
 	if conn.isAborting() {
 		return errors.New(fmt.Sprintf("connection %v->%v is aborting", conn.LocalAddr(), conn.RemoteAddr()))
 	}
+	if conn.isReadExpired() {
+		return timeoutError{}
+	}
+	if conn.isReadClosed() {
+		// CloseRead only silences the local application; the peer may still
+		// be sending, so keep acking to avoid stalling its send window.
+		C.tcp_recved(conn.pcb, C.u16_t(len(data)))
+		return nil
+	}
 	// Unlocks lwip thread during sending data to remote, gives other goroutines
 	// chances to interact with the lwip thread. Assuming lwip thread has already
 	// been locked.
@@ -112,6 +163,68 @@ func (conn *tcpConn) Receive(data []byte) error {
 	return nil
 }
 
+// Write buffers data into conn's elastic ring buffer instead of blocking
+// for lwIP to actually drain it. It blocks only while the ring already
+// holds at least the write high-water mark, and then appends all of data,
+// which may take the ring past the mark. It never touches lwipMutex
+// itself, so concurrent proxy goroutines make progress independently of
+// lwIP's ACK cadence instead of serializing on the single lwIP mutex; the
+// flusher, driven by the Sent/Poll callbacks on the lwIP thread (and by
+// CloseWrite), batches buffered writes into tcp_write calls as snd_buf
+// frees up.
+func (conn *tcpConn) Write(data []byte) (int, error) {
+	atomic.AddInt32(&conn.inFlightWriters, 1)
+	defer atomic.AddInt32(&conn.inFlightWriters, -1)
+
+	conn.canWrite.L.Lock()
+	for conn.bufferedLen() >= conn.writeHighWaterMark() {
+		if err := conn.writeBlockedErr(); err != nil {
+			conn.canWrite.L.Unlock()
+			return 0, err
+		}
+		conn.canWrite.Wait()
+	}
+	conn.canWrite.L.Unlock()
+
+	// The ring may be below the high-water mark even though the connection
+	// has since been closed/aborted/timed out - check again so a Write that
+	// never blocks still honors them instead of silently buffering onto a
+	// connection that's going away.
+	if err := conn.writeBlockedErr(); err != nil {
+		return 0, err
+	}
+
+	conn.writeBufMu.Lock()
+	n, _ := conn.writeBuf.Write(data)
+	conn.writeBufMu.Unlock()
+
+	// Deliberately not flushing here: that would take lwipMutex on every
+	// Write, serializing concurrent proxy goroutines back onto the single
+	// lwIP mutex - exactly what buffering into the ring was meant to avoid.
+	// The Sent/Poll callbacks, which already run on the lwIP thread holding
+	// lwipMutex, drain the ring instead; TCP_POLL_INTERVAL bounds the worst
+	// case latency until that happens.
+	return n, nil
+}
+
+// writeBlockedErr reports the error Write should return right now instead
+// of buffering/blocking, or nil if the connection is healthy.
+func (conn *tcpConn) writeBlockedErr() error {
+	if conn.isLocalClosed() {
+		return fmt.Errorf("connection %v->%v was closed by local", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	if conn.isAborting() {
+		return fmt.Errorf("connection %v->%v is aborting", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	if conn.isWriteExpired() {
+		return timeoutError{}
+	}
+	if conn.isWriteClosed() {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
 // tcpWrite enqueues data to snd_buf, and treats ERR_MEM returned by tcp_write not an error,
 // but instead tells the caller that data is not successfully enqueued, and should try
 // again another time. By calling this function, the lwIP thread is assumed to be already
@@ -127,46 +240,119 @@ func (conn *tcpConn) tcpWrite(data []byte) (int, error) {
 	return 0, fmt.Errorf("lwip tcp_write failed with error code: %v", int(err))
 }
 
-func (conn *tcpConn) Write(data []byte) (int, error) {
-	totalWritten := 0
-	conn.canWrite.L.Lock()
-	for len(data) > 0 {
-		if conn.isLocalClosed() {
-			return 0, fmt.Errorf("connection %v->%v was closed by local", conn.LocalAddr(), conn.RemoteAddr())
-		}
-		if conn.isAborting() {
-			return 0, fmt.Errorf("connection %v->%v is aborting", conn.LocalAddr(), conn.RemoteAddr())
-		}
+// flush acquires lwipMutex and hands off to flushLocked. Use this from
+// outside the lwIP thread, e.g. from CloseWrite; Write itself never calls it.
+func (conn *tcpConn) flush() error {
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	return conn.flushLocked()
+}
 
-		lwipMutex.Lock()
-		toWrite := len(data)
-		if toWrite > int(conn.pcb.snd_buf) {
-			// Write at most the size of the LWIP buffer.
-			toWrite = int(conn.pcb.snd_buf)
+// flushLocked moves as much of the buffered ring as snd_buf currently
+// allows into lwIP, via as few tcp_write calls as the ring's wraparound
+// permits. The caller must already hold lwipMutex - Sent/Poll call this
+// directly since the lwIP thread invokes them with lwipMutex already
+// locked, and re-locking it here would deadlock it. A tcp_write failure
+// aborts the connection, since there is no caller left blocked in Write to
+// report it to synchronously.
+func (conn *tcpConn) flushLocked() error {
+	conn.writeBufMu.Lock()
+	defer conn.writeBufMu.Unlock()
+
+	for {
+		chunk := conn.writeBuf.PeekContiguous(int(conn.pcb.snd_buf))
+		if len(chunk) == 0 {
+			break
 		}
-		if toWrite > 0 {
-			written, err := conn.tcpWrite(data[0:toWrite])
-			totalWritten += written
-			if err != nil {
-				lwipMutex.Unlock()
-				conn.canWrite.L.Unlock()
-				return totalWritten, err
-			}
-			data = data[written:len(data)]
+		written, err := conn.tcpWrite(chunk)
+		if err != nil {
+			conn.Lock()
+			conn.aborting = true
+			conn.Unlock()
+			conn.canWrite.Broadcast()
+			return err
 		}
-		lwipMutex.Unlock()
-		if len(data) == 0 {
-			break // Don't block if all the data has been written.
+		if written == 0 {
+			// ERR_MEM: snd_buf is exhausted for now, try again on the next
+			// Sent/Poll callback.
+			break
 		}
-		conn.canWrite.Wait()
+		conn.writeBuf.Discard(written)
 	}
-	conn.canWrite.L.Unlock()
 
-	return totalWritten, nil
+	var shutdownErr error
+	if conn.writeBuf.Len() == 0 {
+		shutdownErr = conn.maybeShutdownWriteLocked()
+	}
+
+	conn.canWrite.Broadcast()
+	return shutdownErr
+}
+
+// maybeShutdownWriteLocked issues tcp_shutdown(tx) the first time it's
+// called after CloseWrite, once flushLocked has observed the write ring
+// fully drained. The caller must already hold lwipMutex, same as
+// flushLocked.
+func (conn *tcpConn) maybeShutdownWriteLocked() error {
+	conn.Lock()
+	pending := conn.writeClosed && !conn.writeShutdown
+	if pending {
+		conn.writeShutdown = true
+	}
+	conn.Unlock()
+	if !pending {
+		return nil
+	}
+
+	if err := C.tcp_shutdown(conn.pcb, 0, 1); err != C.ERR_OK {
+		conn.Lock()
+		conn.aborting = true
+		conn.Unlock()
+		return errors.New(fmt.Sprintf("shutdown write side of TCP connection failed, lwip error code %d", int(err)))
+	}
+	return nil
+}
+
+// bufferedLen returns how many bytes are currently sitting in the write
+// ring, waiting for flush to hand them to lwIP.
+func (conn *tcpConn) bufferedLen() int {
+	conn.writeBufMu.Lock()
+	defer conn.writeBufMu.Unlock()
+	return conn.writeBuf.Len()
+}
+
+func (conn *tcpConn) writeHighWaterMark() int {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.writeBufHighWaterMark
+}
+
+// Buffered returns the number of bytes written but not yet handed to lwIP.
+func (conn *tcpConn) Buffered() int {
+	return conn.bufferedLen()
+}
+
+// SetWriteBuffer sets the high-water mark, in bytes, at which Write starts
+// blocking instead of continuing to buffer data locally. Named to match
+// net.TCPConn.SetWriteBuffer, though unlike the kernel socket buffer it
+// tunes, this bounds an in-process ring buffer.
+func (conn *tcpConn) SetWriteBuffer(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("write buffer size must be positive, got %d", n)
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	conn.writeBufHighWaterMark = n
+	return nil
 }
 
 func (conn *tcpConn) Sent(len uint16) error {
 	conn.handler.DidSend(conn, len)
+	// Called on the lwIP thread with lwipMutex already held, so use the
+	// already-locked flusher. A flush failure marks the connection as
+	// aborting, which makes further Writes fail; CheckState below only acts
+	// on it (tcp_abort and LWIP_ERR_ABRT) once the local side has closed.
+	conn.flushLocked()
 	// Some packets are acknowledged by local client, check if any pending data to send.
 	return conn.CheckState()
 }
@@ -189,6 +375,120 @@ func (conn *tcpConn) isLocalClosed() bool {
 	return conn.localClosed
 }
 
+func (conn *tcpConn) isWriteClosed() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.writeClosed
+}
+
+func (conn *tcpConn) isReadClosed() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.readClosed
+}
+
+func (conn *tcpConn) isReadExpired() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.readExpired
+}
+
+func (conn *tcpConn) isWriteExpired() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.writeExpired
+}
+
+// TODO: udpConn needs the same SetDeadline/SetReadDeadline/SetWriteDeadline
+// support, but this package doesn't have a UDP connection type yet - there's
+// nothing to attach it to until one lands.
+
+// SetReadDeadline implements net.Conn. A zero time.Time clears the deadline.
+// Expiry is delivered to Receive, and also cancels conn.ctx (see
+// ContextualConnectionHandler).
+func (conn *tcpConn) SetReadDeadline(t time.Time) error {
+	conn.Lock()
+	conn.readDeadlineGen++
+	gen := conn.readDeadlineGen
+	if conn.readDeadline != nil {
+		conn.readDeadline.Stop()
+		conn.readDeadline = nil
+	}
+	conn.readExpired = false
+	if !t.IsZero() {
+		d := time.Until(t)
+		if d <= 0 {
+			conn.readExpired = true
+			conn.Unlock()
+			conn.cancel()
+			return nil
+		}
+		conn.readDeadline = time.AfterFunc(d, func() { conn.readTimedOut(gen) })
+	}
+	conn.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. A zero time.Time clears the deadline.
+// Expiry wakes up a blocked Write via canWrite.Broadcast and cancels conn.ctx.
+func (conn *tcpConn) SetWriteDeadline(t time.Time) error {
+	conn.Lock()
+	conn.writeDeadlineGen++
+	gen := conn.writeDeadlineGen
+	if conn.writeDeadline != nil {
+		conn.writeDeadline.Stop()
+		conn.writeDeadline = nil
+	}
+	conn.writeExpired = false
+	if !t.IsZero() {
+		d := time.Until(t)
+		if d <= 0 {
+			conn.writeExpired = true
+			conn.Unlock()
+			conn.canWrite.Broadcast()
+			conn.cancel()
+			return nil
+		}
+		conn.writeDeadline = time.AfterFunc(d, func() { conn.writeTimedOut(gen) })
+	}
+	conn.Unlock()
+	return nil
+}
+
+// SetDeadline implements net.Conn by applying t to both the read and write
+// deadlines.
+func (conn *tcpConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+func (conn *tcpConn) readTimedOut(gen uint64) {
+	conn.Lock()
+	if gen != conn.readDeadlineGen {
+		// Superseded by a later SetReadDeadline before this timer fired.
+		conn.Unlock()
+		return
+	}
+	conn.readExpired = true
+	conn.Unlock()
+	conn.cancel()
+}
+
+func (conn *tcpConn) writeTimedOut(gen uint64) {
+	conn.Lock()
+	if gen != conn.writeDeadlineGen {
+		// Superseded by a later SetWriteDeadline before this timer fired.
+		conn.Unlock()
+		return
+	}
+	conn.writeExpired = true
+	conn.Unlock()
+	conn.canWrite.Broadcast()
+	conn.cancel()
+}
+
 func (conn *tcpConn) CheckState() error {
 	if !conn.isLocalClosed() {
 		// Signal the writer to try writting.
@@ -197,15 +497,26 @@ func (conn *tcpConn) CheckState() error {
 		return NewLWIPError(LWIP_ERR_OK)
 	}
 
-	if conn.isClosing() || conn.isLocalClosed() {
-		conn.closeInternal()
-	}
-
+	// Abort and graceful close are mutually exclusive teardown routes for
+	// the same pcb: tcp_close followed by tcp_abort (or vice versa) is a
+	// use-after-free on lwIP's side. Abort takes priority and skips the
+	// graceful path entirely, discarding whatever is still buffered.
 	if conn.isAborting() {
 		conn.abortInternal()
 		return NewLWIPError(LWIP_ERR_ABRT)
 	}
 
+	if conn.bufferedLen() > 0 {
+		// Still have data sitting in the write ring; defer the graceful
+		// close until flush has handed it all to lwIP, which it'll keep
+		// trying to do on the next Sent/Poll callback.
+		return NewLWIPError(LWIP_ERR_OK)
+	}
+
+	if conn.isClosing() || conn.isLocalClosed() {
+		conn.closeInternal()
+	}
+
 	return NewLWIPError(LWIP_ERR_OK)
 }
 
@@ -213,12 +524,64 @@ func (conn *tcpConn) Close() error {
 	conn.Lock()
 	defer conn.Unlock()
 
+	if atomic.LoadInt32(&conn.inFlightWriters) > 0 {
+		// A Write may be waiting on canWrite for the write ring to drop below
+		// the high-water mark, which a graceful close would leave it doing.
+		// Abort instead, mirroring crypto/tls's fix for Close racing an
+		// in-flight Write, so the waiting Write observes isAborting() and
+		// returns promptly.
+		conn.aborting = true
+		conn.canWrite.Broadcast()
+		return nil
+	}
+
 	// Close maybe called outside of lwIP thread, we should not call tcp_close() in this
 	// function, instead just make a flag to indicate we are closing the connection.
 	conn.closing = true
 	return nil
 }
 
+// CloseWrite shuts down the write side of the connection, signalling the
+// remote peer that no more data is coming while still letting Receive
+// deliver whatever the peer sends until it FINs in turn. It mirrors
+// net.TCPConn's CloseWrite and lets bidirectional proxy handlers forward
+// an EOF in one direction without tearing down the whole flow.
+//
+// tcp_shutdown is not called directly here: bytes may still be sitting
+// unflushed in the write ring, and shutting down the TX side before they
+// are handed to lwIP would FIN ahead of them, truncating the stream.
+// flushLocked issues it once the ring has fully drained, either in the
+// flush CloseWrite runs below or in whichever later Sent/Poll callback
+// observes that.
+func (conn *tcpConn) CloseWrite() error {
+	conn.Lock()
+	if conn.writeClosed {
+		conn.Unlock()
+		return nil
+	}
+	conn.writeClosed = true
+	conn.Unlock()
+	conn.canWrite.Broadcast()
+
+	return conn.flush()
+}
+
+// CloseRead shuts down the read side of the connection. Subsequent Receive
+// calls drop the payload and immediately tcp_recved it to keep the peer's
+// send window open, without calling into the handler.
+func (conn *tcpConn) CloseRead() error {
+	conn.Lock()
+	conn.readClosed = true
+	conn.Unlock()
+
+	lwipMutex.Lock()
+	defer lwipMutex.Unlock()
+	if err := C.tcp_shutdown(conn.pcb, 1, 0); err != C.ERR_OK {
+		return errors.New(fmt.Sprintf("shutdown read side of TCP connection failed, lwip error code %d", int(err)))
+	}
+	return nil
+}
+
 func (conn *tcpConn) setLocalClosed() error {
 	conn.Lock()
 	defer conn.Unlock()
@@ -260,6 +623,7 @@ func (conn *tcpConn) Abort() {
 
 	conn.aborting = true
 	conn.canWrite.Broadcast()
+	conn.cancel()
 }
 
 // The corresponding pcb is already freed when this callback is called
@@ -283,5 +647,7 @@ func (conn *tcpConn) Release() {
 }
 
 func (conn *tcpConn) Poll() error {
+	// Called on the lwIP thread with lwipMutex already held; see flushLocked.
+	conn.flushLocked()
 	return conn.CheckState()
 }